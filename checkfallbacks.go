@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -17,7 +16,6 @@ import (
 	"net/http/httputil"
 	"os"
 	"runtime"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -46,14 +44,26 @@ const (
 var (
 	help          = flag.Bool("help", false, "Get usage help")
 	verbose       = flag.Bool("verbose", false, "Be verbose (useful for manual testing)")
-	fallbacksFile = flag.String("fallbacks", "fallbacks.json", "File containing json array of fallback information")
+	fallbacksFile = flag.String("fallbacks", "fallbacks.json", "File containing fallback information, as either a json array of arrays or a yaml map (e.g. a freshly pulled proxies.yaml.gz)")
+	fallbacksURL  = flag.String("fallbacks-url", "", "If set, fetch and gunzip a remote yaml fallbacks config from this URL instead of reading -fallbacks")
 	numConns      = flag.Int("connections", 1, "Number of simultaneous connections")
 	verify        = flag.Bool("verify", false, "Set to true to verify upstream connectivity")
 	checks        = flag.Int("checks", 1, "Number of times to check in each connection. Useful to detect blocking after a few packets being exchanged")
 	timeout       = flag.Duration("timeout", 30*time.Second, "Time out checks after this time amount of time")
+	outputFormat  = flag.String("output", "text", "Output format for per-fallback results: text or json")
+	reportFile    = flag.String("report", "", "If set, write a single JSON document with per-fallback results grouped by protocol to this file")
+	daemon        = flag.Bool("daemon", false, "Run forever, testing fallbacks on -interval and exporting Prometheus metrics instead of exiting after one pass")
+	interval      = flag.Duration("interval", 5*time.Minute, "In -daemon mode, how long to wait after one pass over all fallbacks completes before starting the next")
+	metricsAddr   = flag.String("metrics-addr", ":9090", "In -daemon mode, address to serve Prometheus metrics on")
+	retries       = flag.Int("retries", 2, "Number of times to retry a check after a transient (dial/TLS/timeout) failure before giving up")
+	retryBase     = flag.Duration("retry-base", 500*time.Millisecond, "Base delay for exponential backoff between retries")
+	retryMax      = flag.Duration("retry-max", 0, "Maximum delay for exponential backoff between retries; if zero or greater than -timeout/2, -timeout/2 is used instead")
+	probesFlag    = flag.String("probes", "", "Comma-separated protocol-behavior probes to run against each connection: ping, upstream, largefetch, slowloris, udp. Defaults to upstream if -verify is set, otherwise ping")
+	largeFetchMB  = flag.Int("largefetch-mb", 5, "Size in MiB (clamped to 1-10) to request in the largefetch probe")
+	slowlorisIdle = flag.Duration("slowloris-idle", 30*time.Second, "How long the slowloris probe leaves a connection idle before writing a byte")
 )
 
-var log = newLogger()
+var baseLog, log = newLogger()
 
 func main() {
 	start := time.Now()
@@ -65,17 +75,66 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *verbose {
+		logLevel.SetLevel(zap.DebugLevel)
+	}
+
+	if *outputFormat != "text" && *outputFormat != "json" {
+		log.Fatalf("Unknown -output format %q, must be text or json", *outputFormat)
+	}
+	validateProbes()
+
 	log.Info("Running checkfallbacks")
 	initFronted()
-	fallbacks := loadFallbacks(*fallbacksFile)
+
+	var fallbacks [][]chained.ChainedServerInfo
+	if *fallbacksURL != "" {
+		fallbacks = loadFallbacksFromURL(*fallbacksURL)
+	} else {
+		fallbacks = loadFallbacks(*fallbacksFile)
+	}
+	validateFallbacks(fallbacks)
+
+	if *daemon {
+		runDaemon(fallbacks)
+		return
+	}
+
+	runPass(fallbacks, start)
+}
+
+// runPass tests all fallbacks once, printing/writing results according to
+// -output and -report, and returns the ok/failed/timeout counts.
+func runPass(fallbacks [][]chained.ChainedServerInfo, start time.Time) (ok, failed, timedOut int) {
 	outputCh := testAllFallbacks(fallbacks)
 	log.Info("Finished testing fallbacks")
+
+	var records []*fallbackRecord
 	for out := range outputCh {
-		// Scripts in lanter_aws repo expect the output formats below.
-		if out.err != nil {
-			fmt.Printf("[failed fallback check] %v\n", out.err)
-		} else {
-			fmt.Printf("Fallback %s OK.\n", out.addr)
+		rec := newFallbackRecord(out)
+		switch {
+		case out.err == nil:
+			ok++
+		case isTimeout(out.err):
+			timedOut++
+		default:
+			failed++
+		}
+
+		if *reportFile != "" {
+			records = append(records, rec)
+		}
+
+		switch *outputFormat {
+		case "json":
+			printJSONRecord(rec)
+		default:
+			// Scripts in lanter_aws repo expect the output formats below.
+			if out.err != nil {
+				fmt.Printf("[failed fallback check] %v\n", out.err)
+			} else {
+				fmt.Printf("Fallback %s OK.\n", out.addr)
+			}
 		}
 		if *verbose && len(out.info) > 0 {
 			for _, msg := range out.info {
@@ -83,7 +142,34 @@ func main() {
 			}
 		}
 	}
-	log.Infof("checkfallbacks completed in %v seconds", time.Since(start).Seconds())
+	duration := time.Since(start)
+
+	if *reportFile != "" {
+		if err := writeReport(*reportFile, records); err != nil {
+			log.Errorf("Unable to write report to %v: %v", *reportFile, err)
+		}
+	}
+
+	if *outputFormat == "json" {
+		printJSONSummary(ok, failed, timedOut, duration)
+	}
+	log.Infof("checkfallbacks completed in %v seconds", duration.Seconds())
+	return
+}
+
+// runDaemon serves Prometheus metrics and re-tests all fallbacks, waiting
+// -interval after each pass completes, instead of exiting after one pass, so
+// operators can run one persistent process per region rather than scraping
+// cron logs.
+func runDaemon(fallbacks [][]chained.ChainedServerInfo) {
+	serveMetrics(*metricsAddr)
+	log.Infof("Running in daemon mode, testing fallbacks every %v", *interval)
+	for {
+		passStart := time.Now()
+		ok, failed, timedOut := runPass(fallbacks, passStart)
+		log.Infof("Daemon pass complete: ok=%d failed=%d timeout=%d", ok, failed, timedOut)
+		time.Sleep(*interval)
+	}
 }
 
 func initFronted() {
@@ -131,38 +217,15 @@ func initFronted() {
 	}
 }
 
-// Load the fallback servers list file. Failure to do so will result in
-// exiting the program.
-func loadFallbacks(filename string) (fallbacks [][]chained.ChainedServerInfo) {
-	if filename == "" {
-		log.Error("Please specify a fallbacks file")
-		flag.Usage()
-		os.Exit(2)
-	}
-
-	fileBytes, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Fatalf("Unable to read fallbacks file at %s: %s", filename, err)
-	}
-
-	err = json.Unmarshal(fileBytes, &fallbacks)
-	if err != nil {
-		log.Fatalf("Unable to unmarshal json from %v: %v", filename, err)
-	}
-
-	// Replace newlines in cert with newline literals
-	for _, fbs := range fallbacks {
-		for _, fb := range fbs {
-			fb.Cert = strings.Replace(fb.Cert, "\n", "\\n", -1)
-		}
-	}
-	return
-}
-
 type fullOutput struct {
-	addr string
-	err  error
-	info []string
+	addr         string
+	proto        string
+	err          error
+	info         []string
+	latency      time.Duration
+	httpStatus   int
+	retryCount   int
+	failureClass string
 }
 
 // Test all fallback servers
@@ -197,7 +260,10 @@ func testAllFallbacks(fallbacks [][]chained.ChainedServerInfo) (output chan *ful
 			go func(i int) {
 				for fb := range fbChan {
 					output <- testFallbackServer(&fb, i)
-					log.Debugf("Tested %d / %d", atomic.AddInt64(&testedCount, 1), numFallbacks)
+					done := atomic.AddInt64(&testedCount, 1)
+					if ce := baseLog.Check(zap.DebugLevel, "tested"); ce != nil {
+						ce.Write(zap.Int64("done", done), zap.Int("total", numFallbacks))
+					}
 				}
 
 				workersWg.Done()
@@ -214,8 +280,6 @@ func testAllFallbacks(fallbacks [][]chained.ChainedServerInfo) (output chan *ful
 
 // Perform the test of an individual server
 func testFallbackServer(fb *chained.ChainedServerInfo, workerID int) (output *fullOutput) {
-	output = &fullOutput{addr: fb.Addr}
-
 	proto := "http"
 	if fb.Cert != "" {
 		proto = "https"
@@ -227,8 +291,12 @@ func testFallbackServer(fb *chained.ChainedServerInfo, workerID int) (output *fu
 	if fb.KCPSettings != nil && len(fb.KCPSettings) > 0 {
 		proto = "kcp"
 	}
+	output = &fullOutput{addr: fb.Addr, proto: proto}
+	workerLog := baseLog.With(zap.Int("worker_id", workerID), zap.String("addr", fb.Addr), zap.String("proto", proto))
+	if ce := workerLog.Check(zap.DebugLevel, "testing"); ce != nil {
+		ce.Write()
+	}
 	name := fmt.Sprintf("%v (%v)", fb.Addr, proto)
-	log.Debugf("Testing %v", name)
 	fb.MaxPreconnect = 1
 	userCfg := common.NewUserConfigData(DeviceID, 0, "", nil, "")
 	dialer, err := client.ChainedDialer(name, fb, userCfg)
@@ -239,9 +307,11 @@ func testFallbackServer(fb *chained.ChainedServerInfo, workerID int) (output *fu
 	c := &http.Client{
 		Transport: &http.Transport{
 			Dial: func(network, addr string) (net.Conn, error) {
+				dialStart := time.Now()
 				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 				defer cancel()
 				conn, _, err := dialer.DialContext(ctx, network, addr)
+				dialDuration.WithLabelValues(fb.Addr, proto).Observe(time.Since(dialStart).Seconds())
 				return conn, err
 			},
 		},
@@ -250,25 +320,26 @@ func testFallbackServer(fb *chained.ChainedServerInfo, workerID int) (output *fu
 		},
 	}
 
-	for i := 0; i < *checks; i++ {
-		if *verify {
-			verifyUpstream(fb, c, workerID, output)
-		} else {
-			ping(fb, c, workerID, output)
-		}
+	rawDial := func(ctx context.Context) (net.Conn, error) {
+		conn, _, err := dialer.DialContext(ctx, "tcp", fb.Addr)
+		return conn, err
+	}
+
+	for _, probeName := range selectedProbes() {
+		runProbe(probeName, fb, c, rawDial, workerLog, output)
 	}
 
 	return
 }
 
-func ping(fb *chained.ChainedServerInfo, c *http.Client, workerID int, output *fullOutput) {
+func ping(fb *chained.ChainedServerInfo, c *http.Client, logger *zap.Logger, output *fullOutput) {
 	req, err := http.NewRequest("GET", "http://ping-chained-server", nil)
 	if err != nil {
 		output.err = fmt.Errorf("%v: NewRequest to ping failed: %v", fb.Addr, err)
 		return
 	}
 	req.Header.Set(common.PingHeader, "1") // request 1 KB
-	doTest(fb, c, workerID, output, req, func(resp *http.Response, body []byte) error {
+	doTest(fb, c, logger, output, req, func(resp *http.Response, body []byte) error {
 		if resp.StatusCode != 200 {
 			return fmt.Errorf("%v: bad status code: %v", fb.Addr, resp.StatusCode)
 		}
@@ -279,13 +350,13 @@ func ping(fb *chained.ChainedServerInfo, c *http.Client, workerID int, output *f
 	})
 }
 
-func verifyUpstream(fb *chained.ChainedServerInfo, c *http.Client, workerID int, output *fullOutput) {
+func verifyUpstream(fb *chained.ChainedServerInfo, c *http.Client, logger *zap.Logger, output *fullOutput) {
 	req, err := http.NewRequest("GET", "http://config.getiantem.org/proxies.yaml.gz", nil)
 	if err != nil {
 		output.err = fmt.Errorf("%v: NewRequest to config.getiantem.org failed: %v", fb.Addr, err)
 		return
 	}
-	doTest(fb, c, workerID, output, req, func(resp *http.Response, body []byte) error {
+	doTest(fb, c, logger, output, req, func(resp *http.Response, body []byte) error {
 		if resp.StatusCode != 200 {
 			return fmt.Errorf("%v: bad status code: %v", fb.Addr, resp.StatusCode)
 		}
@@ -308,49 +379,139 @@ func verifyUpstream(fb *chained.ChainedServerInfo, c *http.Client, workerID int,
 	})
 }
 
-func doTest(fb *chained.ChainedServerInfo, c *http.Client, workerID int, output *fullOutput, req *http.Request, verify func(resp *http.Response, body []byte) error) {
-	errCh := make(chan error, 0)
+// doTest runs one logical check, retrying transient (dial/TLS/timeout)
+// failures with exponential backoff while treating HTTP and body-validation
+// failures as terminal. Only the last attempt's -verbose dump is kept: a
+// retried check otherwise accumulates one dump block per attempt, multiplying
+// the record by the retry count instead of describing the final outcome.
+func doTest(fb *chained.ChainedServerInfo, c *http.Client, logger *zap.Logger, output *fullOutput, req *http.Request, verify func(resp *http.Response, body []byte) error) {
+	start := time.Now()
+
+	var outcome attemptOutcome
+	attempt := 1
+	for ; ; attempt++ {
+		outcome = attemptRequest(fb, c, output.proto, logger, req, verify)
+		if outcome.err == nil || attempt > *retries || !isRetryableFailure(outcome.class) {
+			break
+		}
+		backoff := retryBackoff(attempt)
+		if ce := logger.Check(zap.DebugLevel, "retrying"); ce != nil {
+			ce.Write(zap.Duration("backoff", backoff), zap.Int("attempt", attempt), zap.Int("max_retries", *retries), zap.Error(outcome.err))
+		}
+		time.Sleep(backoff)
+	}
+
+	// err, failureClass, httpStatus and retryCount all describe the same
+	// final attempt and must move together: setting output.err here (even
+	// to nil on success) means a later success clears any error recorded by
+	// an earlier, now-superseded attempt instead of leaving it sticky next
+	// to a classification/status that no longer matches it.
+	output.err = outcome.err
+	output.failureClass = outcome.class
+	output.httpStatus = outcome.httpStatus
+	output.retryCount = attempt - 1
+	if len(outcome.info) > 0 {
+		output.info = append(output.info, outcome.info...)
+	}
+
+	output.latency = time.Since(start)
+	recordResult(output.addr, output.proto, output.err)
+}
+
+// attemptOutcome is the result of a single attemptRequest call. Everything
+// doTest needs to record on output travels through this value rather than
+// being written directly by attemptRequest's inner goroutine, so that two
+// overlapping attempts (see attemptRequest) never write output concurrently.
+type attemptOutcome struct {
+	err        error
+	class      string
+	info       []string
+	httpStatus int
+}
+
+// attemptRequest performs a single dial+request+verify attempt, bounded by
+// -timeout, and classifies the failure (if any) as "dial", "tls", "http",
+// "body" or "timeout".
+//
+// req is cloned with its own per-attempt context rather than reused
+// in-place: doTest calls attemptRequest again, with the same req, after a
+// timeout, and the previous attempt's goroutine may still be running at
+// that point. Mutating the same http.Request (and its Header map) from two
+// goroutines at once is a data race, so each attempt gets its own clone.
+// On timeout, the per-attempt context is canceled and attemptRequest waits
+// for the goroutine to actually exit before returning, so the next attempt
+// never overlaps with this one and only ever one goroutine is in flight.
+func attemptRequest(fb *chained.ChainedServerInfo, c *http.Client, proto string, logger *zap.Logger, req *http.Request, verify func(resp *http.Response, body []byte) error) attemptOutcome {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// req.WithContext only shallow-copies the Request; Header still needs its
+	// own copy so this attempt's Header.Set calls can't race a previous
+	// attempt's.
+	attemptReq := req.WithContext(ctx)
+	attemptReq.Header = make(http.Header, len(req.Header))
+	for k, vv := range req.Header {
+		vv2 := make([]string, len(vv))
+		copy(vv2, vv)
+		attemptReq.Header[k] = vv2
+	}
+
+	resCh := make(chan attemptOutcome, 1)
 
 	go func() {
-		req.Header.Set(common.DeviceIdHeader, DeviceID)
-		req.Header.Set(common.TokenHeader, fb.AuthToken)
+		attemptReq.Header.Set(common.DeviceIdHeader, DeviceID)
+		attemptReq.Header.Set(common.TokenHeader, fb.AuthToken)
 
+		var info []string
 		if *verbose {
-			reqStr, _ := httputil.DumpRequestOut(req, true)
-			output.info = []string{"\n" + string(reqStr)}
+			reqStr, _ := httputil.DumpRequestOut(attemptReq, true)
+			info = append(info, "\n"+string(reqStr))
 		}
 
-		resp, err := c.Do(req)
+		doStart := time.Now()
+		resp, err := c.Do(attemptReq)
+		checkDuration.WithLabelValues(fb.Addr, proto).Observe(time.Since(doStart).Seconds())
 		if err != nil {
-			errCh <- fmt.Errorf("%v: ping failed: %v", fb.Addr, err)
+			resCh <- attemptOutcome{err: fmt.Errorf("%v: ping failed: %v", fb.Addr, err), class: classifyDialErr(err), info: info}
 			return
 		}
+		httpStatus := resp.StatusCode
 		if *verbose {
 			respStr, _ := httputil.DumpResponse(resp, true)
-			output.info = append(output.info, "\n"+string(respStr))
+			info = append(info, "\n"+string(respStr))
 		}
 		defer func() {
 			if closeErr := resp.Body.Close(); closeErr != nil {
-				log.Debugf("Unable to close response body: %v", closeErr)
+				if ce := logger.Check(zap.DebugLevel, "unable to close response body"); ce != nil {
+					ce.Write(zap.Error(closeErr))
+				}
 			}
 		}()
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			errCh <- fmt.Errorf("%v: error reading response body: %v", fb.Addr, err)
+			resCh <- attemptOutcome{err: fmt.Errorf("%v: error reading response body: %v", fb.Addr, err), class: "body", info: info, httpStatus: httpStatus}
 			return
 		}
 
-		err = verify(resp, body)
-		errCh <- err
+		if err := verify(resp, body); err != nil {
+			class := "body"
+			if httpStatus != http.StatusOK {
+				class = "http"
+			}
+			resCh <- attemptOutcome{err: err, class: class, info: info, httpStatus: httpStatus}
+			return
+		}
+		resCh <- attemptOutcome{info: info, httpStatus: httpStatus}
 	}()
 
 	select {
-	case err := <-errCh:
-		if err != nil {
-			output.err = err
-		}
+	case res := <-resCh:
+		return res
 	case <-time.After(*timeout):
-		output.err = fmt.Errorf("%v: check timed out", fb.Addr)
+		cancel()
+		res := <-resCh
+		res.err = fmt.Errorf("%v: check timed out", fb.Addr)
+		res.class = "timeout"
+		return res
 	}
 }
 
@@ -362,7 +523,19 @@ type lumberjackSink struct {
 // by the embedded *lumberjack.Logger.
 func (lumberjackSink) Sync() error { return nil }
 
-func newLogger() *zap.SugaredLogger {
+// logLevel gates both of newLogger's cores. It defaults to InfoLevel and is
+// raised to DebugLevel in main once -verbose is parsed, so that
+// baseLog.Check(zap.DebugLevel, ...) on hot paths actually short-circuits
+// (skipping the argument allocations) when -verbose is off, instead of
+// always returning a non-nil entry because some core is unconditionally at
+// DebugLevel.
+var logLevel = zap.NewAtomicLevelAt(zap.InfoLevel)
+
+// newLogger builds the base *zap.Logger along with its sugared wrapper. The
+// raw logger is exposed alongside the sugared one so hot paths can use
+// logger.Check() to avoid formatting log arguments when debug logging is
+// disabled.
+func newLogger() (*zap.Logger, *zap.SugaredLogger) {
 	dir := logDir()
 	os.Mkdir(dir, os.ModePerm)
 	enc := zap.NewProductionEncoderConfig()
@@ -376,13 +549,13 @@ func newLogger() *zap.SugaredLogger {
 	})
 
 	core := zapcore.NewTee(
-		zapcore.NewCore(fileEncoder, w, zap.DebugLevel),
-		zapcore.NewCore(zapcore.NewConsoleEncoder(enc), zapcore.AddSync(os.Stdout), zap.DebugLevel),
+		zapcore.NewCore(fileEncoder, w, logLevel),
+		zapcore.NewCore(zapcore.NewConsoleEncoder(enc), zapcore.AddSync(os.Stdout), logLevel),
 	)
 
-	log := zap.New(core)
+	base := zap.New(core)
 
-	return log.Sugar()
+	return base, base.Sugar()
 }
 
 func logDir() string {
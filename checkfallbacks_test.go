@@ -8,7 +8,7 @@ import (
 )
 
 func TestJSONloading(t *testing.T) {
-	logger := newLogger()
+	_, logger := newLogger()
 	logger.Debug("Running test")
 	fallbacks := loadFallbacks("test.json")
 
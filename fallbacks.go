@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getlantern/flashlight/chained"
+	"github.com/getlantern/yaml"
+)
+
+// Load the fallback servers list file. Failure to do so will result in
+// exiting the program. The file may be either the flat json array-of-arrays
+// layout or a yaml map matching config.getiantem.org/proxies.yaml.gz,
+// detected by extension or, failing that, by content.
+func loadFallbacks(filename string) (fallbacks [][]chained.ChainedServerInfo) {
+	if filename == "" {
+		log.Error("Please specify a fallbacks file")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fileBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("Unable to read fallbacks file at %s: %s", filename, err)
+	}
+
+	fallbacks, err = parseFallbacks(fileBytes, filename)
+	if err != nil {
+		log.Fatalf("Unable to parse fallbacks from %v: %v", filename, err)
+	}
+	normalizeCerts(fallbacks)
+	return
+}
+
+// loadFallbacksFromURL fetches and gunzips a remote yaml fallbacks config,
+// such as config.getiantem.org/proxies.yaml.gz, directly.
+func loadFallbacksFromURL(url string) (fallbacks [][]chained.ChainedServerInfo) {
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Fatalf("Unable to fetch fallbacks from %v: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Unexpected response status fetching fallbacks from %v: %v", url, resp.Status)
+	}
+
+	gzipReader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		log.Fatalf("Unable to open gzip reader for fallbacks from %v: %v", url, err)
+	}
+
+	fileBytes, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		log.Fatalf("Unable to read fallbacks from %v: %v", url, err)
+	}
+
+	fallbacks, err = parseFallbacks(fileBytes, url)
+	if err != nil {
+		log.Fatalf("Unable to parse fallbacks from %v: %v", url, err)
+	}
+	normalizeCerts(fallbacks)
+	return
+}
+
+// parseFallbacks sniffs data by the extension of name, falling back to
+// content sniffing, and parses it as either the json array-of-arrays layout
+// or the yaml map layout.
+func parseFallbacks(data []byte, name string) (fallbacks [][]chained.ChainedServerInfo, err error) {
+	if isYAMLFallbacks(data, name) {
+		return parseYAMLFallbacks(data)
+	}
+	err = json.Unmarshal(data, &fallbacks)
+	return
+}
+
+// isYAMLFallbacks reports whether data should be parsed as the yaml map
+// layout rather than the json array-of-arrays layout.
+func isYAMLFallbacks(data []byte, name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	case ".json":
+		return false
+	}
+	// Fall back to content sniffing: the json layout always starts with '[',
+	// the yaml map layout never does.
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) == 0 || trimmed[0] != '['
+}
+
+// parseYAMLFallbacks parses the yaml map layout used by
+// config.getiantem.org/proxies.yaml.gz, wrapping each entry in its own
+// single-element chain so it fits the internal [][]chained.ChainedServerInfo
+// shape.
+func parseYAMLFallbacks(data []byte) ([][]chained.ChainedServerInfo, error) {
+	cfgs := make(map[string]*chained.ChainedServerInfo)
+	if err := yaml.Unmarshal(data, &cfgs); err != nil {
+		return nil, err
+	}
+
+	fallbacks := make([][]chained.ChainedServerInfo, 0, len(cfgs))
+	for _, fb := range cfgs {
+		fallbacks = append(fallbacks, []chained.ChainedServerInfo{*fb})
+	}
+	return fallbacks, nil
+}
+
+func normalizeCerts(fallbacks [][]chained.ChainedServerInfo) {
+	// Replace newlines in cert with newline literals
+	for _, fbs := range fallbacks {
+		for _, fb := range fbs {
+			fb.Cert = strings.Replace(fb.Cert, "\n", "\\n", -1)
+		}
+	}
+}
+
+// validateFallbacks logs a warning for any fallback address that appears
+// more than once, or that has no cert configured, before workers start
+// testing them.
+func validateFallbacks(fallbacks [][]chained.ChainedServerInfo) {
+	seen := make(map[string]bool)
+	for _, fbs := range fallbacks {
+		for _, fb := range fbs {
+			if seen[fb.Addr] {
+				log.Warnf("Duplicate fallback address: %v", fb.Addr)
+			}
+			seen[fb.Addr] = true
+
+			if fb.Cert == "" {
+				log.Warnf("Fallback %v has no cert configured", fb.Addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	checkTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "checkfallbacks",
+		Name:      "check_total",
+		Help:      "Total number of fallback checks, by result (ok, failed or timeout).",
+	}, []string{"addr", "proto", "result"})
+
+	dialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "checkfallbacks",
+		Name:      "dial_duration_seconds",
+		Help:      "Time spent dialing a fallback server, excluding the request itself.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"addr", "proto"})
+
+	checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "checkfallbacks",
+		Name:      "check_duration_seconds",
+		Help:      "Time spent in a single request round trip to a fallback server up to the response headers, including any dial it needs and excluding retry backoff sleeps.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"addr", "proto"})
+
+	lastSuccessTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "checkfallbacks",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful check of a fallback server.",
+	}, []string{"addr"})
+
+	up = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "checkfallbacks",
+		Name:      "up",
+		Help:      "Whether the last check of a fallback server succeeded (1) or not (0).",
+	}, []string{"addr"})
+)
+
+func init() {
+	prometheus.MustRegister(checkTotal, dialDuration, checkDuration, lastSuccessTimestamp, up)
+}
+
+// serveMetrics starts an HTTP server exposing Prometheus metrics at /metrics
+// on addr. It runs in the background; failures to bind are fatal since a
+// daemon without metrics defeats the point of running one.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Unable to serve metrics on %v: %v", addr, err)
+		}
+	}()
+	log.Infof("Serving Prometheus metrics on %v/metrics", addr)
+}
+
+// recordResult updates checkTotal, up and lastSuccessTimestamp for a single
+// completed check of the fallback at addr.
+func recordResult(addr, proto string, err error) {
+	result := "ok"
+	if err != nil {
+		if isTimeout(err) {
+			result = "timeout"
+		} else {
+			result = "failed"
+		}
+	}
+	checkTotal.WithLabelValues(addr, proto, result).Inc()
+
+	if err == nil {
+		lastSuccessTimestamp.WithLabelValues(addr).Set(float64(time.Now().Unix()))
+		up.WithLabelValues(addr).Set(1)
+	} else {
+		up.WithLabelValues(addr).Set(0)
+	}
+}
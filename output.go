@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// fallbackRecord is the machine-readable representation of a fullOutput,
+// suitable for NDJSON streaming or grouping into a report document.
+type fallbackRecord struct {
+	Addr         string   `json:"addr"`
+	Protocol     string   `json:"protocol"`
+	Error        string   `json:"error,omitempty"`
+	LatencyMS    int64    `json:"latency_ms"`
+	HTTPStatus   int      `json:"http_status,omitempty"`
+	Retries      int      `json:"retries"`
+	FailureClass string   `json:"failure_class,omitempty"`
+	Info         []string `json:"info,omitempty"`
+}
+
+// summaryRecord is the final NDJSON record emitted after all fallbacks have
+// been tested in -output=json mode.
+type summaryRecord struct {
+	OK       int     `json:"ok"`
+	Failed   int     `json:"failed"`
+	Timeout  int     `json:"timeout"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// reportDocument is the document written to -report, grouping results by
+// protocol so an operator can quickly see which transports are unhealthy.
+type reportDocument struct {
+	GeneratedAt time.Time                    `json:"generated_at"`
+	Protocols   map[string][]*fallbackRecord `json:"protocols"`
+}
+
+func newFallbackRecord(out *fullOutput) *fallbackRecord {
+	rec := &fallbackRecord{
+		Addr:       out.addr,
+		Protocol:   out.proto,
+		LatencyMS:  int64(out.latency / time.Millisecond),
+		HTTPStatus: out.httpStatus,
+		Retries:    out.retryCount,
+		Info:       out.info,
+	}
+	if out.err != nil {
+		rec.Error = out.err.Error()
+		rec.FailureClass = out.failureClass
+	}
+	return rec
+}
+
+// isTimeout reports whether err is the "check timed out" error produced by
+// doTest, as opposed to a dial/HTTP/body failure.
+func isTimeout(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "check timed out")
+}
+
+func printJSONRecord(rec *fallbackRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("Unable to marshal fallback record for %v: %v", rec.Addr, err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+func printJSONSummary(ok, failed, timeout int, duration time.Duration) {
+	b, err := json.Marshal(&summaryRecord{
+		OK:       ok,
+		Failed:   failed,
+		Timeout:  timeout,
+		Duration: duration.Seconds(),
+	})
+	if err != nil {
+		log.Errorf("Unable to marshal summary record: %v", err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// writeReport writes a single JSON document grouping records by protocol to
+// filename.
+func writeReport(filename string, records []*fallbackRecord) error {
+	doc := &reportDocument{
+		GeneratedAt: time.Now(),
+		Protocols:   make(map[string][]*fallbackRecord),
+	}
+	for _, rec := range records {
+		doc.Protocols[rec.Protocol] = append(doc.Protocols[rec.Protocol], rec)
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal report: %v", err)
+	}
+	return os.WriteFile(filename, b, 0644)
+}
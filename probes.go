@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/flashlight/chained"
+	"github.com/getlantern/flashlight/common"
+	"go.uber.org/zap"
+)
+
+// validProbes is the set of probe names recognized by runProbe.
+var validProbes = map[string]bool{
+	"ping":       true,
+	"upstream":   true,
+	"largefetch": true,
+	"slowloris":  true,
+	"udp":        true,
+}
+
+// selectedProbes returns the ordered list of probes to run against each
+// connection. -probes takes priority; absent that, -verify preserves its
+// historical meaning of running the upstream config fetch instead of a
+// plain ping.
+func selectedProbes() []string {
+	if *probesFlag != "" {
+		parts := strings.Split(*probesFlag, ",")
+		names := make([]string, len(parts))
+		for i, p := range parts {
+			names[i] = strings.TrimSpace(p)
+		}
+		return names
+	}
+	if *verify {
+		return []string{"upstream"}
+	}
+	return []string{"ping"}
+}
+
+// validateProbes exits the program if -probes names an unrecognized probe,
+// mirroring the -output validation in main.
+func validateProbes() {
+	for _, name := range selectedProbes() {
+		if !validProbes[name] {
+			log.Fatalf("Unknown probe %q in -probes, must be one of ping, upstream, largefetch, slowloris, udp", name)
+		}
+	}
+}
+
+// rawDialFunc opens a new raw tunnel connection to the fallback, bypassing
+// the http.Client used by the ping/upstream/largefetch probes. slowloris and
+// udp need direct control of idle time and framing, which an http.Client
+// round trip doesn't expose.
+type rawDialFunc func(ctx context.Context) (net.Conn, error)
+
+// runProbe dispatches a single named probe. ping and upstream set
+// output.err/latency through doTest as before; the newer probes instead
+// append a timing/error record to output.info, since a degraded large
+// transfer or a killed idle connection doesn't necessarily mean the
+// fallback itself is down the way a failed ping does.
+func runProbe(name string, fb *chained.ChainedServerInfo, c *http.Client, dial rawDialFunc, logger *zap.Logger, output *fullOutput) {
+	switch name {
+	case "ping":
+		for i := 0; i < *checks; i++ {
+			ping(fb, c, logger, output)
+		}
+	case "upstream":
+		for i := 0; i < *checks; i++ {
+			verifyUpstream(fb, c, logger, output)
+		}
+	case "largefetch":
+		largeFetchProbe(fb, c, logger, output)
+	case "slowloris":
+		slowlorisProbe(fb, dial, logger, output)
+	case "udp":
+		if fb.KCPSettings == nil || len(fb.KCPSettings) == 0 {
+			if ce := logger.Check(zap.DebugLevel, "skipping udp probe: no KCP settings"); ce != nil {
+				ce.Write()
+			}
+			return
+		}
+		udpProbe(fb, dial, logger, output)
+	}
+}
+
+// largeFetchProbe streams largeFetchMB (clamped to 1-10) MiB from the
+// fallback using the same ping-header size request as ping, and records
+// achieved throughput or a mid-stream reset as an info line. Large transfers
+// are more likely than a 1 KB ping to trip a per-connection byte cap.
+func largeFetchProbe(fb *chained.ChainedServerInfo, c *http.Client, logger *zap.Logger, output *fullOutput) {
+	mb := *largeFetchMB
+	if mb < 1 {
+		mb = 1
+	} else if mb > 10 {
+		mb = 10
+	}
+
+	req, err := http.NewRequest("GET", "http://ping-chained-server", nil)
+	if err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe largefetch] NewRequest failed: %v", err))
+		return
+	}
+	req.Header.Set(common.PingHeader, strconv.Itoa(mb*1024)) // request mb MiB
+	req.Header.Set(common.DeviceIdHeader, DeviceID)
+	req.Header.Set(common.TokenHeader, fb.AuthToken)
+
+	// Unlike the dial, c.Do/body read has no built-in bound -- a fallback
+	// that accepts the request and then stalls mid-stream would otherwise
+	// hang this worker forever, which never recovers across -daemon passes.
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe largefetch] %d MiB fetch failed: %v", mb, err))
+		return
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe largefetch] reset after %d/%d bytes in %v: %v", n, mb*1024*1024, elapsed, err))
+		return
+	}
+
+	mbps := float64(n) / elapsed.Seconds() / (1024 * 1024)
+	if ce := logger.Check(zap.DebugLevel, "largefetch probe"); ce != nil {
+		ce.Write(zap.Int64("bytes", n), zap.Duration("elapsed", elapsed))
+	}
+	output.info = append(output.info, fmt.Sprintf("[probe largefetch] fetched %d bytes in %v (%.2f MiB/s)", n, elapsed, mbps))
+}
+
+// slowlorisProbe opens a raw tunnel connection, waits -slowloris-idle with
+// no traffic, then writes a single byte to detect fallbacks or middleboxes
+// that kill idle connections rather than forwarding arbitrary traffic
+// indefinitely.
+func slowlorisProbe(fb *chained.ChainedServerInfo, dial rawDialFunc, logger *zap.Logger, output *fullOutput) {
+	ctx, cancel := context.WithTimeout(context.Background(), *slowlorisIdle+*timeout)
+	defer cancel()
+
+	conn, err := dial(ctx)
+	if err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe slowloris] dial failed: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	if ce := logger.Check(zap.DebugLevel, "slowloris probe: idling"); ce != nil {
+		ce.Write(zap.Duration("idle", *slowlorisIdle))
+	}
+	time.Sleep(*slowlorisIdle)
+
+	conn.SetWriteDeadline(time.Now().Add(*timeout))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe slowloris] write after %v idle failed, connection killed: %v", *slowlorisIdle, err))
+		return
+	}
+
+	// A local write can succeed even after the remote has reset an idle
+	// connection -- it just lands in the kernel's send buffer. Follow it
+	// with a read so a reset/EOF is what actually decides survival, rather
+	// than the write alone.
+	conn.SetReadDeadline(time.Now().Add(*timeout))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// No reply within -timeout, but no reset/EOF either: the byte
+			// was forwarded and nothing answered it, which is expected for
+			// a live, non-echoing tunnel.
+			output.info = append(output.info, fmt.Sprintf("[probe slowloris] connection survived %v idle", *slowlorisIdle))
+			return
+		}
+		output.info = append(output.info, fmt.Sprintf("[probe slowloris] connection killed after %v idle: %v", *slowlorisIdle, err))
+		return
+	}
+
+	output.info = append(output.info, fmt.Sprintf("[probe slowloris] connection survived %v idle (remote replied)", *slowlorisIdle))
+}
+
+// udpProbe dials a fresh raw tunnel connection and issues a minimal ping
+// request directly over it, bypassing the shared http.Client/connection
+// pool used by the other probes. Lantern fallbacks are HTTP-proxy tunnels,
+// not echo servers, so this doesn't assume the server reflects raw bytes
+// back; it reuses the same ping-chained-server round trip ping() in
+// checkfallbacks.go already relies on, which confirms the KCP transport
+// actually forwards and returns a request rather than just accepting a
+// dial. Callers should only invoke this when fb.KCPSettings is set.
+func udpProbe(fb *chained.ChainedServerInfo, dial rawDialFunc, logger *zap.Logger, output *fullOutput) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	conn, err := dial(ctx)
+	if err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe udp] dial failed: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://ping-chained-server", nil)
+	if err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe udp] NewRequest failed: %v", err))
+		return
+	}
+	req.Header.Set(common.PingHeader, "1") // request 1 KB
+	req.Header.Set(common.DeviceIdHeader, DeviceID)
+	req.Header.Set(common.TokenHeader, fb.AuthToken)
+
+	conn.SetDeadline(time.Now().Add(*timeout))
+	start := time.Now()
+	if err := req.Write(conn); err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe udp] write failed: %v", err))
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		output.info = append(output.info, fmt.Sprintf("[probe udp] read response failed after %v: %v", time.Since(start), err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		output.info = append(output.info, fmt.Sprintf("[probe udp] bad status code: %v", resp.StatusCode))
+		return
+	}
+
+	elapsed := time.Since(start)
+	if ce := logger.Check(zap.DebugLevel, "udp probe"); ce != nil {
+		ce.Write(zap.Duration("elapsed", elapsed))
+	}
+	output.info = append(output.info, fmt.Sprintf("[probe udp] round-trip in %v", elapsed))
+}
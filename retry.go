@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// classifyDialErr classifies a c.Do failure as "dial" or "tls" based on the
+// underlying error text. The chained dialer wraps errors with fmt.Errorf
+// rather than %w, so text matching is the only option available here.
+func classifyDialErr(err error) string {
+	if strings.Contains(strings.ToLower(err.Error()), "tls") {
+		return "tls"
+	}
+	return "dial"
+}
+
+// isRetryableFailure reports whether a failure of the given classification
+// is transient and worth retrying. HTTP and body-validation failures are
+// terminal: retrying them just wastes a cycle on a fallback that is
+// deterministically broken.
+func isRetryableFailure(class string) bool {
+	switch class {
+	case "dial", "tls", "timeout":
+		return true
+	default:
+		return false
+	}
+}
+
+// retryBackoff computes the exponential-backoff-with-jitter delay before
+// retry attempt n (n=1 is the delay before the second overall attempt),
+// capped at -retry-max (or -timeout/2 if -retry-max is unset or too large).
+func retryBackoff(attempt int) time.Duration {
+	backoff := *retryBase << uint(attempt-1)
+
+	maxBackoff := *retryMax
+	if maxBackoff <= 0 || maxBackoff > *timeout/2 {
+		maxBackoff = *timeout / 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(backoff/4) + 1))
+	backoff += jitter
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}